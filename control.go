@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const statsPushInterval = 2 * time.Second
+
+// rtpSenderStats accumulates the outbound byte and inbound-NACK counters
+// attachControlChannel reports in its periodic stats push. bytes is
+// updated by StreamHub's fan-out writes, nacks by the RTCP read loop
+// signal/wsSignal already run per sender.
+type rtpSenderStats struct {
+	bytes uint64
+	nacks uint64
+}
+
+// controlMessage is one command a viewer's "control" data channel can send:
+// {"cmd":"pause"}, {"cmd":"resume"}, {"cmd":"seek","ms":12345} or
+// {"cmd":"rate","x":1.5}.
+type controlMessage struct {
+	Cmd  string  `json:"cmd"`
+	MS   int64   `json:"ms"`
+	Rate float64 `json:"x"`
+}
+
+// statsMessage is what the server periodically pushes back over the same
+// data channel while it's open.
+type statsMessage struct {
+	Type       string `json:"type"`
+	VideoBytes uint64 `json:"videoBytes"`
+	AudioBytes uint64 `json:"audioBytes"`
+	VideoNACKs uint64 `json:"videoNacks"`
+	AudioNACKs uint64 `json:"audioNacks"`
+}
+
+// offerHasDataChannel reports whether offerSDP already has an m=application
+// section. A PeerConnection answering an offer can't unilaterally add a new
+// media section of its own in the same offer/answer round, so the client
+// must call createDataChannel (for "control" or anything else) before it
+// creates its offer for attachControlChannel's channel to actually open.
+func offerHasDataChannel(offerSDP string) bool {
+	var parsed sdp.SessionDescription
+	if err := parsed.Unmarshal([]byte(offerSDP)); err != nil {
+		return false
+	}
+
+	for _, desc := range parsed.MediaDescriptions {
+		if desc.MediaName.Media == "application" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attachControlChannel opens a "control" data channel on pc and wires it
+// into hub's shared playback commands, turning the previously fire-and-
+// forget sender into an interactive play/pause/seek/rate player. Since the
+// hub only reads videos/output.ivf and videos/output.ogg once for every
+// viewer, a command from any one viewer's channel steers playback for all
+// of them, like a shared watch-party remote rather than independent
+// per-viewer VOD control. A hub backed by ingestSource registers no command
+// listeners, so on it these commands have no effect.
+//
+// The caller must check offerHasDataChannel first: an answerer cannot add
+// an m=application section the offer didn't already have, so this only
+// actually reaches the browser if the client pre-creates its own data
+// channel (any label) before calling createOffer.
+func attachControlChannel(pc *webrtc.PeerConnection, hub *StreamHub, videoStats, audioStats *rtpSenderStats) {
+	dc, err := pc.CreateDataChannel("control", nil)
+	if err != nil {
+		fmt.Printf("control: create data channel failed: %v\n", err)
+		return
+	}
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var cmd controlMessage
+		if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+			fmt.Printf("control: bad message: %v\n", err)
+			return
+		}
+
+		hub.Control(PlaybackCommand{Cmd: cmd.Cmd, MS: cmd.MS, Rate: cmd.Rate})
+	})
+
+	dc.OnOpen(func() {
+		go pushStats(dc, videoStats, audioStats)
+	})
+}
+
+// readRTCP drains sender's incoming RTCP reports for as long as the
+// connection lives. Before these packets are returned they are processed
+// by interceptors; for things like NACK this needs to be called. Each
+// TransportLayerNack report bumps stats.nacks.
+func readRTCP(sender *webrtc.RTPSender, stats *rtpSenderStats) {
+	rtcpBuf := make([]byte, 1500)
+	for {
+		n, _, err := sender.Read(rtcpBuf)
+		if err != nil {
+			return
+		}
+
+		packets, err := rtcp.Unmarshal(rtcpBuf[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, pkt := range packets {
+			if _, ok := pkt.(*rtcp.TransportLayerNack); ok {
+				atomic.AddUint64(&stats.nacks, 1)
+			}
+		}
+	}
+}
+
+// pushStats sends a "stats" message over dc every statsPushInterval until
+// dc closes.
+func pushStats(dc *webrtc.DataChannel, videoStats, audioStats *rtpSenderStats) {
+	ticker := time.NewTicker(statsPushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if dc.ReadyState() != webrtc.DataChannelStateOpen {
+			return
+		}
+
+		payload, err := json.Marshal(statsMessage{
+			Type:       "stats",
+			VideoBytes: atomic.LoadUint64(&videoStats.bytes),
+			AudioBytes: atomic.LoadUint64(&audioStats.bytes),
+			VideoNACKs: atomic.LoadUint64(&videoStats.nacks),
+			AudioNACKs: atomic.LoadUint64(&audioStats.nacks),
+		})
+		if err != nil {
+			continue
+		}
+
+		if err := dc.SendText(string(payload)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	ingestVideoPort = 5004 // VP8 video
+	ingestAudioPort = 5005 // Opus audio
+)
+
+// No listener is opened on ingestVideoPort/ingestAudioPort themselves; they
+// only mark where the port range ends below onDemandIngests' allocations.
+
+// ingestSource lets an external encoder (ffmpeg, GStreamer, OBS) push live
+// media into the server over RTP instead of only serving pre-converted
+// IVF/OGG files. It listens on videoPort/audioPort and forwards whatever it
+// receives straight into the hub's RTP tracks, so there's no decode/re-encode
+// step on the server at all.
+type ingestSource struct {
+	videoPort int
+	audioPort int
+}
+
+// newIngestSource builds an ingestSource reading from its own UDP port
+// pair, so each on-demand transcode (onDemandIngests, below) gets a source
+// that can't collide with any other stream's RTP on the wire.
+func newIngestSource(videoPort, audioPort int) ingestSource {
+	return ingestSource{videoPort: videoPort, audioPort: audioPort}
+}
+
+func (s ingestSource) newVideoTrack() (webrtc.TrackLocal, error) {
+	return webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion")
+}
+
+func (s ingestSource) newAudioTrack() (webrtc.TrackLocal, error) {
+	return webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+}
+
+func (s ingestSource) Start(hub *StreamHub) {
+	go listenAndForwardRTP(s.videoPort, hub.writeVideoRTP)
+	go listenAndForwardRTP(s.audioPort, hub.writeAudioRTP)
+}
+
+// listenAndForwardRTP opens a UDP socket on port and hands every packet it
+// receives to forward after parsing it with pion/rtp.
+func listenAndForwardRTP(port int, forward func(pkt *rtp.Packet)) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("ingest: udp read on :%d failed: %v\n", port, err)
+			return
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(buf[:n]); err != nil {
+			fmt.Printf("ingest: rtp unmarshal on :%d failed: %v\n", port, err)
+			continue
+		}
+
+		forward(pkt)
+	}
+}
+
+// transcodeToIngest spawns ffmpeg to decode input and re-encode it as
+// VP8/Opus RTP aimed at videoPort/audioPort, so a request like
+// /video/?name=foo.mp4 can be transcoded on demand instead of requiring a
+// pre-converted IVF/OGG pair on disk.
+func transcodeToIngest(input string, videoPort, audioPort int) (*exec.Cmd, error) {
+	cmd := exec.Command("ffmpeg",
+		"-re", "-i", input,
+		"-an", "-vcodec", "libvpx", "-f", "rtp", fmt.Sprintf("rtp://127.0.0.1:%d", videoPort),
+		"-vn", "-acodec", "libopus", "-f", "rtp", fmt.Sprintf("rtp://127.0.0.1:%d", audioPort),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+// ingestStream is one on-demand transcode target: its own ffmpeg process,
+// its own UDP port pair and its own StreamHub. Each distinct input gets one
+// of these so that two unrelated transcodes (say ?name=a.mp4 and
+// ?name=b.mp4) never write RTP onto the same ports or fan out to each
+// other's viewers, the way sharing a single hub/port pair across every name
+// would.
+type ingestStream struct {
+	cmd      *exec.Cmd
+	hub      *StreamHub
+	refCount int
+}
+
+// ingestRegistry hands out an ingestStream per distinct on-demand transcode
+// input, allocating each one a fresh UDP port pair.
+type ingestRegistry struct {
+	mu       sync.Mutex
+	nextPort int
+	streams  map[string]*ingestStream
+}
+
+// onDemandIngests backs every /video/?name=... transcode that isn't the
+// pre-converted IVF/OGG pair. Port allocation starts right after the
+// well-known ingestVideoPort/ingestAudioPort pair and only ever grows; for a
+// lab server that's an acceptable tradeoff for never reusing a port pair
+// while its ffmpeg process might still be shutting down.
+var onDemandIngests = &ingestRegistry{nextPort: ingestAudioPort + 1, streams: make(map[string]*ingestStream)}
+
+// acquire returns the StreamHub for input, starting ffmpeg and a dedicated
+// listener pair on first use and joining the existing stream otherwise. The
+// returned release must be called exactly once, when the viewer that called
+// acquire disconnects; the stream's ffmpeg process is killed and reaped once
+// its last viewer releases it.
+func (r *ingestRegistry) acquire(input string) (hub *StreamHub, release func(), err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream, ok := r.streams[input]
+	if !ok {
+		videoPort, audioPort := r.nextPort, r.nextPort+1
+		r.nextPort += 2
+
+		cmd, err := transcodeToIngest(input, videoPort, audioPort)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stream = &ingestStream{cmd: cmd, hub: NewStreamHub(newIngestSource(videoPort, audioPort))}
+		r.streams[input] = stream
+
+		go func() {
+			if waitErr := cmd.Wait(); waitErr != nil {
+				fmt.Printf("ingest: ffmpeg for %s exited: %v\n", input, waitErr)
+			}
+		}()
+	}
+
+	stream.refCount++
+
+	var once sync.Once
+	return stream.hub, func() { once.Do(func() { r.release(input) }) }, nil
+}
+
+// release drops input's refcount and kills its ffmpeg process once the
+// last viewer using it has gone.
+func (r *ingestRegistry) release(input string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream, ok := r.streams[input]
+	if !ok {
+		return
+	}
+
+	stream.refCount--
+	if stream.refCount > 0 {
+		return
+	}
+
+	delete(r.streams, input)
+	if err := stream.cmd.Process.Kill(); err != nil {
+		fmt.Printf("ingest: kill ffmpeg for %s failed: %v\n", input, err)
+	}
+}
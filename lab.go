@@ -1,20 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
-	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
-	"github.com/pion/webrtc/v3/pkg/media/oggreader"
 )
 
 const (
@@ -39,8 +39,6 @@ type Video struct {
 	Name string
 }
 
-var peerConnection *webrtc.PeerConnection
-
 func readVideoByChunk(source string, conn *websocket.Conn) {
 	file, err := os.Open(source)
 
@@ -80,6 +78,25 @@ func readVideoByChunk(source string, conn *websocket.Conn) {
 	fmt.Println("total bytes: ", n_bytes, "total chunks: ", n_chunks)
 }
 
+// releaseKey is the context key signal stashes an on-demand transcode's
+// release func under, so the handler that started it (/video/) and the one
+// that knows when the viewer disconnects (signal's OnConnectionStateChange)
+// don't need a direct reference to each other.
+type releaseKey struct{}
+
+// withTranscodeRelease attaches release to r's context so signal can call it
+// once the resulting PeerConnection goes away.
+func withTranscodeRelease(r *http.Request, release func()) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), releaseKey{}, release))
+}
+
+// transcodeReleaseFromContext returns the release func withTranscodeRelease
+// attached to r, or nil if none was.
+func transcodeReleaseFromContext(r *http.Request) func() {
+	release, _ := r.Context().Value(releaseKey{}).(func())
+	return release
+}
+
 func renderTemplate(writer http.ResponseWriter, temp string, page *Page) {
 	err := templates.ExecuteTemplate(writer, temp, page)
 
@@ -88,221 +105,122 @@ func renderTemplate(writer http.ResponseWriter, temp string, page *Page) {
 	}
 }
 
-func streamMedia(peerConnection webrtc.PeerConnection) {
-	// Create a video track
-	videoTrack, videoTrackErr := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion")
-	if videoTrackErr != nil {
-		panic(videoTrackErr)
-	}
-
-	rtpSender, videoTrackErr := peerConnection.AddTrack(videoTrack)
-	if videoTrackErr != nil {
-		panic(videoTrackErr)
-	}
-
-	// Read incoming RTCP packets
-	// Before these packets are returned they are processed by interceptors. For things
-	// like NACK this needs to be called.
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
-		}
-	}()
-
-	go func() {
-		// Open a IVF file and start reading using our IVFReader
-		file, ivfErr := os.Open(videoFileName)
-		if ivfErr != nil {
-			panic(ivfErr)
-		}
-
-		ivf, header, ivfErr := ivfreader.NewWith(file)
-		if ivfErr != nil {
-			panic(ivfErr)
-		}
-
-		// Wait for connection established
-		// <-iceConnectedCtx.Done()
-
-		// Send our video file frame at a time. Pace our sending so we send it at the same speed it should be played back as.
-		// This isn't required since the video is timestamped, but we will such much higher loss if we send all at once.
-		//
-		// It is important to use a time.Ticker instead of time.Sleep because
-		// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
-		// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
-		ticker := time.NewTicker(time.Millisecond * time.Duration((float32(header.TimebaseNumerator)/float32(header.TimebaseDenominator))*1000))
-		for ; true; <-ticker.C {
-			frame, _, ivfErr := ivf.ParseNextFrame()
-			if ivfErr == io.EOF {
-				fmt.Printf("All video frames parsed and sent")
-				// os.Exit(0)
-				break
-			}
-
-			if ivfErr != nil {
-				panic(ivfErr)
-			}
-
-			if ivfErr = videoTrack.WriteSample(media.Sample{Data: frame, Duration: time.Second}); ivfErr != nil {
-				panic(ivfErr)
-			}
+// signal handles one viewer's offer/answer exchange. Unlike the old
+// single-PeerConnection version, it builds a fresh PeerConnection per
+// request and subscribes it to hub, so concurrent viewers each get their own
+// ICE/DTLS session while sharing the same decoded-file pacing loop.
+func signal(hub *StreamHub, settingEngine webrtc.SettingEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
 
-	// Create a audio track
-	audioTrack, audioTrackErr := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
-	if audioTrackErr != nil {
-		panic(audioTrackErr)
-	}
-
-	rtpaSender, audioTrackErr := peerConnection.AddTrack(audioTrack)
-	if audioTrackErr != nil {
-		panic(audioTrackErr)
-	}
-
-	// Read incoming RTCP packets
-	// Before these packets are returned they are processed by interceptors. For things
-	// like NACK this needs to be called.
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpaSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
+		var offer webrtc.SessionDescription
+		if err = json.Unmarshal(body, &offer); err != nil {
+			log.Panic(err)
 		}
-	}()
 
-	go func() {
-		// Open a OGG file and start reading using our OGGReader
-		file, oggErr := os.Open(audioFileName)
-		if oggErr != nil {
-			panic(oggErr)
+		pc, err := newPeerConnectionForOffer(offer.SDP, settingEngine, webrtc.Configuration{})
+		if errors.Is(err, errUnsupportedCodec) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
 		}
-
-		// Open on oggfile in non-checksum mode.
-		ogg, _, oggErr := oggreader.NewWith(file)
-		if oggErr != nil {
-			panic(oggErr)
+		if err != nil {
+			log.Panic(err)
 		}
 
-		// Wait for connection established
-
-		// Keep track of last granule, the difference is the amount of samples in the buffer
-		var lastGranule uint64
-
-		// It is important to use a time.Ticker instead of time.Sleep because
-		// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
-		// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
-		ticker := time.NewTicker(oggPageDuration)
-		for ; true; <-ticker.C {
-			pageData, pageHeader, oggErr := ogg.ParseNextPage()
-			if oggErr == io.EOF {
-				fmt.Printf("All audio pages parsed and sent")
-				// os.Exit(0)
-				break
-			}
-
-			if oggErr != nil {
-				panic(oggErr)
-			}
-
-			// The amount of samples is the difference between the last and current timestamp
-			sampleCount := float64(pageHeader.GranulePosition - lastGranule)
-			lastGranule = pageHeader.GranulePosition
-			sampleDuration := time.Duration((sampleCount/48000)*1000) * time.Millisecond
-
-			if oggErr = audioTrack.WriteSample(media.Sample{Data: pageData, Duration: sampleDuration}); oggErr != nil {
-				panic(oggErr)
-			}
+		sub, err := hub.Subscribe(pc)
+		if err != nil {
+			log.Panic(err)
 		}
-	
-	}()
-}
 
-func signal(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
+		videoSender, err := pc.AddTrack(sub.VideoTrack)
 		if err != nil {
-			log.Fatal(err)
+			log.Panic(err)
 		}
-		
-		var offer webrtc.SessionDescription
-		 
-		err = json.Unmarshal(body, &offer)
+		audioSender, err := pc.AddTrack(sub.AudioTrack)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		if err = peerConnection.SetRemoteDescription(offer); err != nil {
+		go readRTCP(videoSender, sub.VideoStats)
+		go readRTCP(audioSender, sub.AudioStats)
+
+		if offerHasDataChannel(offer.SDP) {
+			attachControlChannel(pc, hub, sub.VideoStats, sub.AudioStats)
+		} else {
+			fmt.Println("control: offer has no m=application section, skipping control channel")
+		}
+
+		// Set the handler for Peer connection state
+		// This will notify you when the peer has connected/disconnected
+		releaseTranscode := transcodeReleaseFromContext(r)
+		pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+			fmt.Printf("Peer Connection State has changed: %s\n", state.String())
+			if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+				sub.Cancel()
+				if releaseTranscode != nil {
+					releaseTranscode()
+				}
+				if cErr := pc.Close(); cErr != nil {
+					fmt.Printf("cannot close peerConnection: %v\n", cErr)
+				}
+			}
+		})
+
+		if err = pc.SetRemoteDescription(offer); err != nil {
 			log.Panic(err)
 		}
 
-		gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+		gatherComplete := webrtc.GatheringCompletePromise(pc)
 
-		answer, err := peerConnection.CreateAnswer(nil)
+		answer, err := pc.CreateAnswer(nil)
 
 		if err != nil {
 			log.Panic(err)
 		}
 
-		if err = peerConnection.SetLocalDescription(answer); err != nil {
+		if err = pc.SetLocalDescription(answer); err != nil {
 			log.Panic(err)
 		}
-		
 
-		<- gatherComplete
-		
-		response, err := json.Marshal(*peerConnection.LocalDescription())
+		<-gatherComplete
+
+		response, err := json.Marshal(*pc.LocalDescription())
 		if err != nil {
 			log.Panic(err)
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(response)
+	}
 }
 func main() {
-	// Create a new RTCPeerConnection
-	var err error
+	settingEngine := loadSettingEngine()
 
-	if peerConnection, err = webrtc.NewPeerConnection(webrtc.Configuration{}); err != nil {
-		panic(err)
-	}
-	defer func() {
-		if cErr := peerConnection.Close(); cErr != nil {
-			fmt.Printf("cannot close peerConnection: %v\n", cErr)
-		}
-	}()
-
-	// Set the handler for ICE connection state
-	// This will notify you when the peer has connected/disconnected
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("Connection State has changed %s \n", connectionState.String())
-		if connectionState == webrtc.ICEConnectionState(webrtc.PeerConnectionStateFailed) {
-			fmt.Printf("ICE Connection state changed: %s\n", connectionState.String())
-			//os.Exit(0)
-		}
-	})
+	fileHub := NewStreamHub(fileSource{})
+	fileSignal := signal(fileHub, settingEngine)
 
-	// Set the handler for Peer connection state
-	// This will notify you when the peer has connected/disconnected
-	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		fmt.Printf("Peer Connection State has changed: %s\n", state.String())
-		if state == webrtc.PeerConnectionStateFailed {
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
-			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
-			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-			fmt.Println("Peer Connection has gone to failed exiting")
-			os.Exit(0)
+	http.HandleFunc("/video/", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+
+		// A name outside the pre-converted IVF/OGG pair is an upload we
+		// transcode on demand, e.g. /video/?name=foo.mp4. onDemandIngests
+		// gives each distinct name its own ffmpeg process, UDP ports and
+		// StreamHub so concurrent distinct names never collide on the wire,
+		// and releaseTranscode kills/reaps the ffmpeg process once this
+		// viewer's PeerConnection goes away.
+		if name != "" && name != filepath.Base(videoFileName) && name != filepath.Base(audioFileName) {
+			hub, releaseTranscode, err := onDemandIngests.acquire(filepath.Join("videos", name))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			signal(hub, settingEngine)(w, withTranscodeRelease(r, releaseTranscode))
+			return
 		}
-	})
 
-
-	http.HandleFunc("/video/", func(w http.ResponseWriter, r *http.Request) {
-		url, _ := r.URL.Parse(r.URL.RawQuery)
-		fmt.Println(url)
 		// Assert that we have an audio or video file
-		// TODO: get video name from request
 		_, err := os.Stat(videoFileName)
 		haveVideoFile := !os.IsNotExist(err)
 
@@ -313,11 +231,11 @@ func main() {
 			panic("Could not find `" + audioFileName + "` or `" + videoFileName + "`")
 		}
 
-		go streamMedia(*peerConnection)
-		signal(w, r)
+		fileSignal(w, r)
 	})
 
-	http.HandleFunc("/signal", signal)
+	http.HandleFunc("/signal", fileSignal)
+	http.HandleFunc("/ws", wsSignal(fileHub, settingEngine))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		dir_entry, err := os.ReadDir("videos")
 
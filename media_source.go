@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// fileSource replays videos/output.ivf and videos/output.ogg from disk,
+// pacing each frame/page out at its original playback speed. Playback is
+// steered by the PlaybackCommand values sent over a viewer's "control" data
+// channel (control.go): pause/resume stop and restart sending on each tick
+// of the pacing ticker (which itself keeps running), rate rescales it, and seek reopens the file and skips ahead to the
+// target timestamp.
+type fileSource struct{}
+
+func (fileSource) newVideoTrack() (webrtc.TrackLocal, error) {
+	return webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion")
+}
+
+func (fileSource) newAudioTrack() (webrtc.TrackLocal, error) {
+	return webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+}
+
+func (fileSource) Start(hub *StreamHub) {
+	go runVideoLoop(hub, hub.subscribeCommands())
+	go runAudioLoop(hub, hub.subscribeCommands())
+}
+
+// runVideoLoop owns the IVF file handle and ticker; it selects on the
+// ticker (send the next frame) and cmds (steer playback) for as long as the
+// file has frames left.
+func runVideoLoop(hub *StreamHub, cmds <-chan PlaybackCommand) {
+	file, ivf, header, err := openIVF(videoFileName)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	frameInterval := ivfFrameInterval(header)
+	ticker := time.NewTicker(frameInterval)
+	defer ticker.Stop()
+
+	paused, rate := false, 1.0
+
+	for {
+		select {
+		case cmd := <-cmds:
+			switch cmd.Cmd {
+			case "pause":
+				paused = true
+			case "resume":
+				paused = false
+			case "rate":
+				if cmd.Rate > 0 {
+					rate = cmd.Rate
+					ticker.Reset(time.Duration(float64(frameInterval) / rate))
+				}
+			case "seek":
+				newFile, newIVF, newHeader, err := openIVF(videoFileName)
+				if err != nil {
+					fmt.Printf("video seek failed: %v\n", err)
+					continue
+				}
+				if err := skipIVFTo(newIVF, newHeader, cmd.MS); err != nil && err != io.EOF {
+					fmt.Printf("video seek failed: %v\n", err)
+				}
+
+				file.Close()
+				file, ivf, header = newFile, newIVF, newHeader
+				frameInterval = ivfFrameInterval(header)
+				ticker.Reset(time.Duration(float64(frameInterval) / rate))
+			}
+
+		case <-ticker.C:
+			if paused {
+				continue
+			}
+
+			frame, _, ivfErr := ivf.ParseNextFrame()
+			if ivfErr == io.EOF {
+				fmt.Printf("All video frames parsed and sent")
+				return
+			}
+			if ivfErr != nil {
+				panic(ivfErr)
+			}
+
+			hub.writeVideoSample(media.Sample{Data: frame, Duration: time.Second})
+		}
+	}
+}
+
+// runAudioLoop is runVideoLoop's audio counterpart, driven by OGG pages and
+// their granule positions instead of IVF frames and timestamps.
+func runAudioLoop(hub *StreamHub, cmds <-chan PlaybackCommand) {
+	file, ogg, err := openOGG(audioFileName)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	// Keep track of last granule, the difference is the amount of samples in the buffer
+	var lastGranule uint64
+
+	ticker := time.NewTicker(oggPageDuration)
+	defer ticker.Stop()
+
+	paused, rate := false, 1.0
+
+	for {
+		select {
+		case cmd := <-cmds:
+			switch cmd.Cmd {
+			case "pause":
+				paused = true
+			case "resume":
+				paused = false
+			case "rate":
+				if cmd.Rate > 0 {
+					rate = cmd.Rate
+					ticker.Reset(time.Duration(float64(oggPageDuration) / rate))
+				}
+			case "seek":
+				newFile, newOgg, err := openOGG(audioFileName)
+				if err != nil {
+					fmt.Printf("audio seek failed: %v\n", err)
+					continue
+				}
+
+				newGranule, err := skipOGGTo(newOgg, cmd.MS)
+				if err != nil && err != io.EOF {
+					fmt.Printf("audio seek failed: %v\n", err)
+				}
+
+				file.Close()
+				file, ogg, lastGranule = newFile, newOgg, newGranule
+				ticker.Reset(time.Duration(float64(oggPageDuration) / rate))
+			}
+
+		case <-ticker.C:
+			if paused {
+				continue
+			}
+
+			pageData, pageHeader, oggErr := ogg.ParseNextPage()
+			if oggErr == io.EOF {
+				fmt.Printf("All audio pages parsed and sent")
+				return
+			}
+			if oggErr != nil {
+				panic(oggErr)
+			}
+
+			// The amount of samples is the difference between the last and current timestamp
+			sampleCount := float64(pageHeader.GranulePosition - lastGranule)
+			lastGranule = pageHeader.GranulePosition
+			sampleDuration := time.Duration((sampleCount/48000)*1000) * time.Millisecond
+
+			hub.writeAudioSample(media.Sample{Data: pageData, Duration: sampleDuration})
+		}
+	}
+}
+
+func openIVF(path string) (*os.File, *ivfreader.IVFReader, *ivfreader.IVFFileHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ivf, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+
+	return file, ivf, header, nil
+}
+
+// ivfFrameInterval is how long one frame should be displayed for, derived
+// from the file's timebase (numerator/denominator seconds per frame).
+func ivfFrameInterval(header *ivfreader.IVFFileHeader) time.Duration {
+	return time.Millisecond * time.Duration((float32(header.TimebaseNumerator)/float32(header.TimebaseDenominator))*1000)
+}
+
+// skipIVFTo reads and discards frames until one reaches targetMS, so
+// playback resumes from there instead of from the top of the file.
+func skipIVFTo(ivf *ivfreader.IVFReader, header *ivfreader.IVFFileHeader, targetMS int64) error {
+	targetTicks := targetMS * int64(header.TimebaseDenominator) / (1000 * int64(header.TimebaseNumerator))
+
+	for {
+		_, frameHeader, err := ivf.ParseNextFrame()
+		if err != nil {
+			return err
+		}
+		if int64(frameHeader.Timestamp) >= targetTicks {
+			return nil
+		}
+	}
+}
+
+func openOGG(path string) (*os.File, *oggreader.OggReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Open on oggfile in non-checksum mode.
+	ogg, _, err := oggreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, ogg, nil
+}
+
+// skipOGGTo reads and discards pages until one reaches the granule position
+// matching targetMS (48kHz Opus), returning that granule so the caller's
+// sample-duration bookkeeping continues from the right place.
+func skipOGGTo(ogg *oggreader.OggReader, targetMS int64) (uint64, error) {
+	targetGranule := uint64(targetMS) * 48
+
+	var lastGranule uint64
+	for {
+		_, pageHeader, err := ogg.ParseNextPage()
+		if err != nil {
+			return lastGranule, err
+		}
+
+		lastGranule = pageHeader.GranulePosition
+		if lastGranule >= targetGranule {
+			return lastGranule, nil
+		}
+	}
+}
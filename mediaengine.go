@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const portRangeConfigFile = "config.json"
+
+// errUnsupportedCodec is returned by mediaEngineForOffer when the remote
+// offer has no video codec our file source can actually produce. signal
+// turns this into an HTTP 415; wsSignal sends it as an "error" message.
+var errUnsupportedCodec = errors.New("no compatible video codec offered")
+
+// portRangeConfig is the on-disk shape of config.json: the ephemeral UDP
+// port window SettingEngine restricts itself to, so the server is
+// deployable behind a firewall with a known port range.
+type portRangeConfig struct {
+	UDPPortMin uint16 `json:"udpPortMin"`
+	UDPPortMax uint16 `json:"udpPortMax"`
+}
+
+// loadSettingEngine builds the SettingEngine every PeerConnection in this
+// process shares. A missing or unreadable config.json just leaves the
+// default (unrestricted) ephemeral port range in place.
+func loadSettingEngine() webrtc.SettingEngine {
+	var se webrtc.SettingEngine
+
+	data, err := os.ReadFile(portRangeConfigFile)
+	if err != nil {
+		return se
+	}
+
+	var cfg portRangeConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		fmt.Printf("config: bad %s: %v\n", portRangeConfigFile, err)
+		return se
+	}
+
+	if cfg.UDPPortMin == 0 || cfg.UDPPortMax == 0 {
+		return se
+	}
+
+	if err := se.SetEphemeralUDPPortRange(cfg.UDPPortMin, cfg.UDPPortMax); err != nil {
+		fmt.Printf("config: invalid udp port range [%d,%d]: %v\n", cfg.UDPPortMin, cfg.UDPPortMax, err)
+	}
+
+	return se
+}
+
+// mediaEngineForOffer builds a MediaEngine carrying only VP8 (payload type
+// 96) and Opus (payload type 111), the codecs our sources produce, instead
+// of pion's full default set. It checks only the offer's video sections for
+// a VP8 rtpmap: any offer without VP8 for video is rejected with
+// errUnsupportedCodec, and Opus is registered whether or not the offer
+// lists it.
+func mediaEngineForOffer(offerSDP string) (*webrtc.MediaEngine, error) {
+	var parsed sdp.SessionDescription
+	if err := parsed.Unmarshal([]byte(offerSDP)); err != nil {
+		return nil, fmt.Errorf("parse offer sdp: %w", err)
+	}
+
+	haveVP8 := false
+	for _, desc := range parsed.MediaDescriptions {
+		if desc.MediaName.Media != "video" {
+			continue
+		}
+		for _, attr := range desc.Attributes {
+			if attr.Key == "rtpmap" && strings.Contains(strings.ToUpper(attr.Value), "VP8") {
+				haveVP8 = true
+			}
+		}
+	}
+
+	if !haveVP8 {
+		return nil, errUnsupportedCodec
+	}
+
+	me := &webrtc.MediaEngine{}
+	if err := me.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+
+	if err := me.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	return me, nil
+}
+
+// newPeerConnectionForOffer is the shared entry point signal and wsSignal
+// use to build a per-client PeerConnection, via a fresh webrtc.API whose
+// MediaEngine matches what offerSDP negotiated and whose SettingEngine
+// carries the configured ephemeral UDP port range.
+func newPeerConnectionForOffer(offerSDP string, settingEngine webrtc.SettingEngine, config webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	me, err := mediaEngineForOffer(offerSDP)
+	if err != nil {
+		return nil, err
+	}
+
+	// webrtc.NewAPI doesn't register any interceptors on its own (unlike
+	// the webrtc.NewPeerConnection convenience helper), so without this the
+	// NACK generator/responder, RTCP report generation and TWCC are all
+	// silently missing from every connection.
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(me, registry); err != nil {
+		return nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(me), webrtc.WithSettingEngine(settingEngine), webrtc.WithInterceptorRegistry(registry))
+	return api.NewPeerConnection(config)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+var iceServers = []webrtc.ICEServer{
+	{URLs: []string{"stun:stun.l.google.com:19302"}},
+}
+
+// wsMessage is the envelope every message on /ws is wrapped in: event names
+// the payload's shape (offer/answer/candidate/provide, plus error when the
+// server rejects an offer), data carries it.
+// This mirrors the provide/candidate event model neko uses for its own
+// WebSocket signaling channel.
+type wsMessage struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// wsSignal upgrades the request to a WebSocket and drives one viewer's
+// trickle-ICE offer/answer exchange over it. Unlike signal's single HTTP
+// POST + GatheringCompletePromise wait, candidates are pushed and accepted
+// as soon as they're available, so a viewer is unblocked well before ICE
+// gathering finishes.
+func wsSignal(hub *StreamHub, settingEngine webrtc.SettingEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			fmt.Printf("ws: upgrade failed: %v\n", err)
+			return
+		}
+		defer conn.Close()
+
+		// gorilla/websocket connections aren't safe for concurrent writers;
+		// OnICECandidate fires on its own goroutine, so serialize sends.
+		var writeMu sync.Mutex
+		send := func(event string, payload interface{}) error {
+			data, err := json.Marshal(payload)
+			if err != nil {
+				return err
+			}
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			return conn.WriteJSON(wsMessage{Event: event, Data: data})
+		}
+
+		if err := send("provide", struct {
+			ICEServers []webrtc.ICEServer `json:"iceServers"`
+		}{iceServers}); err != nil {
+			fmt.Printf("ws: send provide failed: %v\n", err)
+			return
+		}
+
+		// The MediaEngine depends on the offer, so pc isn't built until the
+		// "offer" message arrives. Candidates that race ahead of it are
+		// queued and replayed once pc exists.
+		var pc *webrtc.PeerConnection
+		var cancel func()
+		var pendingCandidates []webrtc.ICECandidateInit
+
+		defer func() {
+			if cancel != nil {
+				cancel()
+			}
+		}()
+
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var msg wsMessage
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				fmt.Printf("ws: bad message: %v\n", err)
+				continue
+			}
+
+			switch msg.Event {
+			case "offer":
+				var offer webrtc.SessionDescription
+				if err := json.Unmarshal(msg.Data, &offer); err != nil {
+					fmt.Printf("ws: bad offer: %v\n", err)
+					continue
+				}
+
+				pc, err = newPeerConnectionForOffer(offer.SDP, settingEngine, webrtc.Configuration{ICEServers: iceServers})
+				if errors.Is(err, errUnsupportedCodec) {
+					if sendErr := send("error", err.Error()); sendErr != nil {
+						fmt.Printf("ws: send error failed: %v\n", sendErr)
+					}
+					return
+				}
+				if err != nil {
+					fmt.Printf("ws: new peer connection failed: %v\n", err)
+					return
+				}
+
+				sub, err := hub.Subscribe(pc)
+				if err != nil {
+					fmt.Printf("ws: subscribe failed: %v\n", err)
+					return
+				}
+				cancel = sub.Cancel
+
+				videoSender, err := pc.AddTrack(sub.VideoTrack)
+				if err != nil {
+					fmt.Printf("ws: add video track failed: %v\n", err)
+					return
+				}
+				audioSender, err := pc.AddTrack(sub.AudioTrack)
+				if err != nil {
+					fmt.Printf("ws: add audio track failed: %v\n", err)
+					return
+				}
+
+				go readRTCP(videoSender, sub.VideoStats)
+				go readRTCP(audioSender, sub.AudioStats)
+
+				if offerHasDataChannel(offer.SDP) {
+					attachControlChannel(pc, hub, sub.VideoStats, sub.AudioStats)
+				} else {
+					fmt.Println("control: offer has no m=application section, skipping control channel")
+				}
+
+				pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+					if c == nil {
+						return
+					}
+					if err := send("candidate", c.ToJSON()); err != nil {
+						fmt.Printf("ws: send candidate failed: %v\n", err)
+					}
+				})
+
+				pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+					fmt.Printf("Peer Connection State has changed: %s\n", state.String())
+					if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+						cancel()
+					}
+				})
+
+				if err := pc.SetRemoteDescription(offer); err != nil {
+					fmt.Printf("ws: set remote description failed: %v\n", err)
+					continue
+				}
+
+				for _, candidate := range pendingCandidates {
+					if err := pc.AddICECandidate(candidate); err != nil {
+						fmt.Printf("ws: add queued ice candidate failed: %v\n", err)
+					}
+				}
+				pendingCandidates = nil
+
+				answer, err := pc.CreateAnswer(nil)
+				if err != nil {
+					fmt.Printf("ws: create answer failed: %v\n", err)
+					continue
+				}
+
+				if err := pc.SetLocalDescription(answer); err != nil {
+					fmt.Printf("ws: set local description failed: %v\n", err)
+					continue
+				}
+
+				if err := send("answer", pc.LocalDescription()); err != nil {
+					fmt.Printf("ws: send answer failed: %v\n", err)
+				}
+
+			case "candidate":
+				var candidate webrtc.ICECandidateInit
+				if err := json.Unmarshal(msg.Data, &candidate); err != nil {
+					fmt.Printf("ws: bad candidate: %v\n", err)
+					continue
+				}
+
+				if pc == nil {
+					pendingCandidates = append(pendingCandidates, candidate)
+					continue
+				}
+
+				if err := pc.AddICECandidate(candidate); err != nil {
+					fmt.Printf("ws: add ice candidate failed: %v\n", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// MediaSource is anything that can drive a StreamHub. fileSource
+// (media_source.go) replays the on-disk IVF/OGG files; ingestSource
+// (ingest.go) forwards live RTP pushed in over UDP. Exactly one source
+// backs a given hub, chosen when the hub is constructed.
+type MediaSource interface {
+	// Start begins producing media into hub. It is invoked at most once,
+	// on the first Subscribe.
+	Start(hub *StreamHub)
+
+	// newVideoTrack/newAudioTrack build the per-subscriber track kind this
+	// source writes to: a TrackLocalStaticSample for decoded samples, or a
+	// TrackLocalStaticRTP for raw packet forwarding.
+	newVideoTrack() (webrtc.TrackLocal, error)
+	newAudioTrack() (webrtc.TrackLocal, error)
+}
+
+// trackedTrack pairs a subscriber's track with the outbound stats counters
+// its control-channel stats push (control.go) reports from.
+type trackedTrack struct {
+	track webrtc.TrackLocal
+	stats *rtpSenderStats
+}
+
+// PlaybackCommand is a request from a viewer's "control" data channel
+// (control.go, see attachControlChannel's doc comment for why this is
+// hub-wide rather than per-viewer) that steers playback for every
+// subscriber of the hub.
+type PlaybackCommand struct {
+	Cmd  string  `json:"cmd"`
+	MS   int64   `json:"ms,omitempty"`
+	Rate float64 `json:"x,omitempty"`
+}
+
+// StreamHub fans the media a single MediaSource produces out to every
+// subscribed viewer, so the source is only ever opened, paced and read once
+// no matter how many PeerConnections are watching it.
+type StreamHub struct {
+	mu sync.RWMutex
+
+	audioTracks []trackedTrack
+	videoTracks []trackedTrack
+
+	commandListeners []chan PlaybackCommand
+
+	once   sync.Once
+	source MediaSource
+}
+
+// NewStreamHub builds a hub backed by source. source isn't started until
+// the first Subscribe, so nothing is opened until someone actually watches.
+func NewStreamHub(source MediaSource) *StreamHub {
+	return &StreamHub{source: source}
+}
+
+// Subscription is what Subscribe hands back: the tracks to add to the
+// viewer's PeerConnection, the stats counters their outbound traffic
+// accumulates into, and a cancel func that drops them from the fan-out.
+type Subscription struct {
+	AudioTrack webrtc.TrackLocal
+	VideoTrack webrtc.TrackLocal
+	AudioStats *rtpSenderStats
+	VideoStats *rtpSenderStats
+	Cancel     func()
+}
+
+// Subscribe registers a new viewer and returns the Subscription that must
+// be wired into pc.
+func (h *StreamHub) Subscribe(pc *webrtc.PeerConnection) (*Subscription, error) {
+	audioTrack, err := h.source.newAudioTrack()
+	if err != nil {
+		return nil, err
+	}
+
+	videoTrack, err := h.source.newVideoTrack()
+	if err != nil {
+		return nil, err
+	}
+
+	audioStats := &rtpSenderStats{}
+	videoStats := &rtpSenderStats{}
+
+	h.mu.Lock()
+	h.audioTracks = append(h.audioTracks, trackedTrack{audioTrack, audioStats})
+	h.videoTracks = append(h.videoTracks, trackedTrack{videoTrack, videoStats})
+	h.mu.Unlock()
+
+	h.once.Do(func() { h.source.Start(h) })
+
+	return &Subscription{
+		AudioTrack: audioTrack,
+		VideoTrack: videoTrack,
+		AudioStats: audioStats,
+		VideoStats: videoStats,
+		Cancel:     func() { h.Unsubscribe(audioTrack, videoTrack) },
+	}, nil
+}
+
+// Unsubscribe drops a viewer's tracks from the fan-out set. Safe to call
+// more than once for the same pair of tracks.
+func (h *StreamHub) Unsubscribe(audioTrack, videoTrack webrtc.TrackLocal) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.audioTracks = removeTrack(h.audioTracks, audioTrack)
+	h.videoTracks = removeTrack(h.videoTracks, videoTrack)
+}
+
+// removeTrack rebuilds tracks without target, the same slice-rebuild approach
+// ghostream uses to drop a departed viewer's track.
+func removeTrack(tracks []trackedTrack, target webrtc.TrackLocal) []trackedTrack {
+	out := make([]trackedTrack, 0, len(tracks))
+	for _, t := range tracks {
+		if t.track != target {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// writeVideoSample fans a decoded video sample out to every subscribed
+// track. Only valid while the hub's source builds tracks with
+// newVideoTrack returning a *webrtc.TrackLocalStaticSample (fileSource).
+func (h *StreamHub) writeVideoSample(sample media.Sample) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, t := range h.videoTracks {
+		if err := t.track.(*webrtc.TrackLocalStaticSample).WriteSample(sample); err != nil {
+			fmt.Printf("video fan-out write failed: %v\n", err)
+			continue
+		}
+		atomic.AddUint64(&t.stats.bytes, uint64(len(sample.Data)))
+	}
+}
+
+// writeAudioSample is writeVideoSample's audio counterpart.
+func (h *StreamHub) writeAudioSample(sample media.Sample) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, t := range h.audioTracks {
+		if err := t.track.(*webrtc.TrackLocalStaticSample).WriteSample(sample); err != nil {
+			fmt.Printf("audio fan-out write failed: %v\n", err)
+			continue
+		}
+		atomic.AddUint64(&t.stats.bytes, uint64(len(sample.Data)))
+	}
+}
+
+// writeVideoRTP forwards one already-encoded RTP packet to every subscribed
+// track. Only valid while the hub's source builds tracks with
+// newVideoTrack returning a *webrtc.TrackLocalStaticRTP (ingestSource).
+func (h *StreamHub) writeVideoRTP(pkt *rtp.Packet) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, t := range h.videoTracks {
+		if err := t.track.(*webrtc.TrackLocalStaticRTP).WriteRTP(pkt); err != nil {
+			fmt.Printf("video RTP fan-out write failed: %v\n", err)
+			continue
+		}
+		atomic.AddUint64(&t.stats.bytes, uint64(len(pkt.Payload)))
+	}
+}
+
+// writeAudioRTP is writeVideoRTP's audio counterpart.
+func (h *StreamHub) writeAudioRTP(pkt *rtp.Packet) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, t := range h.audioTracks {
+		if err := t.track.(*webrtc.TrackLocalStaticRTP).WriteRTP(pkt); err != nil {
+			fmt.Printf("audio RTP fan-out write failed: %v\n", err)
+			continue
+		}
+		atomic.AddUint64(&t.stats.bytes, uint64(len(pkt.Payload)))
+	}
+}
+
+// Control delivers cmd to every pacing loop currently listening (registered
+// via subscribeCommands). Non-blocking: each listener queues up to 4
+// commands, and a command for a listener whose queue is already full is
+// dropped rather than stalling playback.
+func (h *StreamHub) Control(cmd PlaybackCommand) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, ch := range h.commandListeners {
+		select {
+		case ch <- cmd:
+		default:
+			fmt.Printf("control: dropped %q, listener busy\n", cmd.Cmd)
+		}
+	}
+}
+
+// subscribeCommands registers a new PlaybackCommand listener. fileSource
+// calls this once per pacing loop (video, audio) so each can react to
+// pause/resume/seek/rate independently.
+func (h *StreamHub) subscribeCommands() <-chan PlaybackCommand {
+	ch := make(chan PlaybackCommand, 4)
+
+	h.mu.Lock()
+	h.commandListeners = append(h.commandListeners, ch)
+	h.mu.Unlock()
+
+	return ch
+}